@@ -0,0 +1,226 @@
+package bitbucket
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io/ioutil"
+	"math"
+	"math/rand"
+	"net/http"
+	"time"
+)
+
+// A DeadLetter is called with the headers and event of an asynchronous
+// delivery whose handler kept failing until RetryPolicy.MaxAttempts was
+// exhausted, along with the last error the handler returned. It is also
+// called, before MaxAttempts is reached, when a redelivery finds the queue
+// full; err then wraps the handler's error as "redelivery queue full: ...".
+type DeadLetter func(headers Headers, event interface{}, err error)
+
+// A RetryPolicy controls how WithAsync redelivers events to a WebhookHandler
+// that returned an error, using exponential backoff with jitter between
+// attempts.
+type RetryPolicy struct {
+	// MaxAttempts is the total number of times a handler is called for an
+	// event, including the first attempt. A value of 1 disables retries.
+	MaxAttempts int
+	// InitialBackoff is the delay before the second attempt.
+	InitialBackoff time.Duration
+	// MaxBackoff caps the delay between attempts before jitter is added, so
+	// the actual delay can be up to 50% longer than MaxBackoff.
+	MaxBackoff time.Duration
+}
+
+// DefaultRetryPolicy is used by WithAsync until SetRetryPolicy overrides it.
+var DefaultRetryPolicy = RetryPolicy{
+	MaxAttempts:    3,
+	InitialBackoff: 500 * time.Millisecond,
+	MaxBackoff:     10 * time.Second,
+}
+
+// backoff returns the delay to wait before the given attempt (2 for the
+// first retry, 3 for the second, ...), doubling each time and capped at
+// MaxBackoff, plus up to 50% jitter to avoid a redelivery thundering herd.
+// Doubling stops as soon as it would overflow time.Duration or exceed
+// MaxBackoff, so a large attempt with no MaxBackoff set can never wrap a
+// Duration negative.
+func (p RetryPolicy) backoff(attempt int) time.Duration {
+	if p.InitialBackoff <= 0 {
+		return 0
+	}
+
+	d := p.InitialBackoff
+	for i := 0; i < attempt-2; i++ {
+		if p.MaxBackoff > 0 && d >= p.MaxBackoff {
+			break
+		}
+		doubled := d * 2
+		if doubled < d {
+			d = math.MaxInt64
+			break
+		}
+		d = doubled
+	}
+	if p.MaxBackoff > 0 && d > p.MaxBackoff {
+		d = p.MaxBackoff
+	}
+
+	withJitter := d + time.Duration(rand.Int63n(int64(d/2+1)))
+	if withJitter < d {
+		return math.MaxInt64
+	}
+	return withJitter
+}
+
+// asyncJob is the unit of work handed off from ServeHTTP to the worker pool
+// started by WithAsync.
+type asyncJob struct {
+	eventKey string
+	headers  Headers
+	event    interface{}
+	attempt  int
+}
+
+// WithAsync switches Webhook into asynchronous delivery mode: ServeHTTP
+// parses and validates the request as usual but, instead of calling the
+// registered handlers on the HTTP goroutine, enqueues the event and responds
+// 202 Accepted immediately. workers goroutines drain the queue and call the
+// handlers registered with Handle, HandleAny and HandleKind; if any of them
+// returns an error, the event is redelivered per SetRetryPolicy
+// (DefaultRetryPolicy if unset) until a delivery succeeds or the attempts
+// run out, in which case the DeadLetter set with SetDeadLetter (if any) is
+// called.
+func (wh *Webhook) WithAsync(workers, queueSize int) {
+	wh.queue = make(chan asyncJob, queueSize)
+	if wh.retryPolicy == (RetryPolicy{}) {
+		wh.retryPolicy = DefaultRetryPolicy
+	}
+
+	for i := 0; i < workers; i++ {
+		wh.workers.Add(1)
+		go wh.worker()
+	}
+}
+
+// SetRetryPolicy overrides DefaultRetryPolicy for asynchronous delivery.
+// Must be called before the first request reaches ServeHTTP.
+func (wh *Webhook) SetRetryPolicy(policy RetryPolicy) {
+	wh.retryPolicy = policy
+}
+
+// SetDeadLetter registers the callback invoked when an asynchronously
+// delivered event exhausts RetryPolicy.MaxAttempts, or when one of its
+// redeliveries finds the queue full.
+func (wh *Webhook) SetDeadLetter(fn DeadLetter) {
+	wh.deadLetter = fn
+}
+
+// serveAsync is ServeHTTP's code path once WithAsync has been called: it
+// parses the event, enqueues it for the worker pool, and returns 202
+// immediately rather than waiting on the handler.
+func (wh *Webhook) serveAsync(w http.ResponseWriter, r *http.Request, headers Headers, eventKey string, body []byte) {
+	if !wh.hasAnyHandlerFor(eventKey) {
+		wh.badRequest(w, r, "No handler for the event key: %s", eventKey)
+		return
+	}
+
+	r.Body = ioutil.NopCloser(bytes.NewReader(body))
+	event, err := wh.Parse(r, eventKey)
+	if err != nil {
+		wh.badRequest(w, r, "Error parsing the event: %s", err)
+		return
+	}
+
+	wh.mu.Lock()
+	if wh.shuttingDown {
+		wh.mu.Unlock()
+		wh.unavailable(w, r, "Webhook is shutting down")
+		return
+	}
+	wh.inFlight.Add(1)
+	wh.mu.Unlock()
+
+	select {
+	case wh.queue <- asyncJob{eventKey: eventKey, headers: headers, event: event, attempt: 1}:
+		w.WriteHeader(http.StatusAccepted)
+	default:
+		wh.inFlight.Done()
+		wh.unavailable(w, r, "Event queue is full")
+	}
+}
+
+// worker drains wh.queue until it's closed by Shutdown.
+func (wh *Webhook) worker() {
+	defer wh.workers.Done()
+	for job := range wh.queue {
+		wh.deliver(job)
+	}
+}
+
+// deliver calls the Handle, HandleAny and HandleKind callbacks registered
+// for job, scheduling a redelivery through RetryPolicy on error, or calling
+// DeadLetter once attempts are exhausted. It calls inFlight.Done exactly
+// once, when job is fully resolved (succeeded, or failed with no redelivery
+// left).
+func (wh *Webhook) deliver(job asyncJob) {
+	err := wh.dispatch(job.eventKey, job.headers, job.event)
+	if err != nil {
+		if job.attempt < wh.retryPolicy.MaxAttempts {
+			job.attempt++
+			time.AfterFunc(wh.retryPolicy.backoff(job.attempt), func() {
+				select {
+				case wh.queue <- job:
+					return
+				default:
+					// Queue is still full; don't block the AfterFunc goroutine
+					// forever. Treat the redelivery itself as exhausted.
+				}
+				if wh.deadLetter != nil {
+					wh.deadLetter(job.headers, job.event, fmt.Errorf("redelivery queue full: %w", err))
+				}
+				wh.inFlight.Done()
+			})
+			return
+		}
+
+		if wh.deadLetter != nil {
+			wh.deadLetter(job.headers, job.event, err)
+		}
+	}
+
+	wh.inFlight.Done()
+}
+
+// Shutdown stops serveAsync from accepting new events, waits for queued and
+// in-flight events (including any pending redeliveries) to finish, then
+// stops the worker pool. It returns ctx.Err() if ctx is done first. Shutdown
+// is a no-op if WithAsync was never called, so it's safe to call
+// unconditionally alongside http.Server.Shutdown. It's safe to call more
+// than once, including concurrently; later calls wait on the same drain.
+func (wh *Webhook) Shutdown(ctx context.Context) error {
+	if wh.queue == nil {
+		return nil
+	}
+
+	wh.shutdownOnce.Do(func() {
+		wh.mu.Lock()
+		wh.shuttingDown = true
+		wh.mu.Unlock()
+
+		wh.drained = make(chan struct{})
+		go func() {
+			wh.inFlight.Wait()
+			close(wh.queue)
+			wh.workers.Wait()
+			close(wh.drained)
+		}()
+	})
+
+	select {
+	case <-wh.drained:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
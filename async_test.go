@@ -0,0 +1,154 @@
+package bitbucket
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestRetryPolicyBackoffDoesNotOverflow(t *testing.T) {
+	p := RetryPolicy{MaxAttempts: 100, InitialBackoff: 500 * time.Millisecond, MaxBackoff: 0}
+	for attempt := 2; attempt < 200; attempt++ {
+		d := p.backoff(attempt)
+		require.GreaterOrEqualf(t, d, time.Duration(0), "attempt %d produced a negative duration", attempt)
+	}
+}
+
+func TestWithAsyncRetriesUntilDeadLetter(t *testing.T) {
+	wh := NewWebhook()
+	wh.WithAsync(2, 4)
+	wh.SetRetryPolicy(RetryPolicy{MaxAttempts: 3, InitialBackoff: time.Millisecond})
+
+	var mu sync.Mutex
+	attempts := 0
+	deadLettered := make(chan error, 1)
+	wh.SetDeadLetter(func(h Headers, e interface{}, err error) {
+		deadLettered <- err
+	})
+
+	wh.Handle("pullrequest:approved", func(h Headers, e interface{}) error {
+		mu.Lock()
+		attempts++
+		mu.Unlock()
+		return errors.New("boom")
+	})
+
+	jsn, err := ioutil.ReadFile("fixtures/pullrequest_approved_event.json")
+	require.Nil(t, err)
+
+	rec := httptest.NewRecorder()
+	req, err := http.NewRequest("POST", "http://example.com", bytes.NewReader(jsn))
+	require.Nil(t, err)
+	req.Header.Add("X-Event-Key", "pullrequest:approved")
+
+	wh.ServeHTTP(rec, req)
+	require.Equal(t, http.StatusAccepted, rec.Code)
+
+	select {
+	case err := <-deadLettered:
+		require.EqualError(t, err, "boom")
+	case <-time.After(time.Second):
+		t.Fatal("event was never dead-lettered")
+	}
+
+	mu.Lock()
+	require.Equal(t, 3, attempts)
+	mu.Unlock()
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	require.NoError(t, wh.Shutdown(ctx))
+}
+
+func TestWithAsyncReachesHandleAnyAndHandleKindOnly(t *testing.T) {
+	wh := NewWebhook()
+	wh.WithAsync(2, 4)
+
+	anyCalled := make(chan CanonicalEvent, 1)
+	wh.HandleAny(func(h Headers, e CanonicalEvent) error {
+		anyCalled <- e
+		return nil
+	})
+
+	kindCalled := make(chan CanonicalEvent, 1)
+	wh.HandleKind(KindPullRequest, func(h Headers, e CanonicalEvent) error {
+		kindCalled <- e
+		return nil
+	}, ActionApprove)
+
+	jsn, err := ioutil.ReadFile("fixtures/pullrequest_approved_event.json")
+	require.Nil(t, err)
+
+	rec := httptest.NewRecorder()
+	req, err := http.NewRequest("POST", "http://example.com", bytes.NewReader(jsn))
+	require.Nil(t, err)
+	req.Header.Add("X-Event-Key", "pullrequest:approved")
+
+	wh.ServeHTTP(rec, req)
+	require.Equal(t, http.StatusAccepted, rec.Code)
+
+	select {
+	case e := <-anyCalled:
+		require.Equal(t, KindPullRequest, e.Kind())
+	case <-time.After(time.Second):
+		t.Fatal("HandleAny was never called")
+	}
+
+	select {
+	case e := <-kindCalled:
+		require.Equal(t, ActionApprove, e.Action())
+	case <-time.After(time.Second):
+		t.Fatal("HandleKind was never called")
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	require.NoError(t, wh.Shutdown(ctx))
+}
+
+func TestShutdownIsSafeToCallTwiceAndConcurrently(t *testing.T) {
+	wh := NewWebhook()
+	wh.WithAsync(2, 4)
+
+	wh.Handle("pullrequest:approved", func(h Headers, e interface{}) error {
+		return nil
+	})
+
+	jsn, err := ioutil.ReadFile("fixtures/pullrequest_approved_event.json")
+	require.Nil(t, err)
+
+	rec := httptest.NewRecorder()
+	req, err := http.NewRequest("POST", "http://example.com", bytes.NewReader(jsn))
+	require.Nil(t, err)
+	req.Header.Add("X-Event-Key", "pullrequest:approved")
+
+	wh.ServeHTTP(rec, req)
+	require.Equal(t, http.StatusAccepted, rec.Code)
+
+	var wg sync.WaitGroup
+	errs := make([]error, 4)
+	for i := 0; i < len(errs); i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+			defer cancel()
+			errs[i] = wh.Shutdown(ctx)
+		}(i)
+	}
+	wg.Wait()
+
+	for _, err := range errs {
+		require.NoError(t, err)
+	}
+
+	require.NoError(t, wh.Shutdown(context.Background()))
+}
@@ -0,0 +1,282 @@
+// Package bitbucketserver provides the types and HTTP handler needed to parse
+// webhooks sent by Bitbucket Server (formerly Stash) and Bitbucket Data Center.
+// It mirrors the sibling `bitbucket` package, which targets Bitbucket Cloud,
+// but the payload shapes differ enough (top-level eventKey/date, actor
+// name/emailAddress instead of username, unix millis timestamps, ref changes
+// instead of push changes) to warrant a separate type tree.
+//
+// See the Bitbucket Server docs for the events and payloads:
+// https://confluence.atlassian.com/bitbucketserver/event-payload-938025882.html
+package bitbucketserver
+
+import (
+	"encoding/json"
+	"time"
+)
+
+// Timestamp unmarshals the unix-millis integers Bitbucket Server uses for its
+// date fields (as opposed to Bitbucket Cloud's RFC3339 strings).
+type Timestamp time.Time
+
+// UnmarshalJSON implements json.Unmarshaler.
+func (t *Timestamp) UnmarshalJSON(data []byte) error {
+	var ms int64
+	if err := json.Unmarshal(data, &ms); err != nil {
+		return err
+	}
+	*t = Timestamp(time.Unix(0, ms*int64(time.Millisecond)))
+	return nil
+}
+
+// Time returns the Timestamp as a time.Time.
+func (t Timestamp) Time() time.Time {
+	return time.Time(t)
+}
+
+// Actor is a common struct used in several types. Unlike Bitbucket Cloud's
+// Actor, Bitbucket Server identifies users by Name and EmailAddress rather
+// than Username.
+type Actor struct {
+	Name         string `json:"name"`
+	EmailAddress string `json:"emailAddress"`
+	ID           int    `json:"id"`
+	DisplayName  string `json:"displayName"`
+	Active       bool   `json:"active"`
+	Slug         string `json:"slug"`
+	Type         string `json:"type"`
+}
+
+// Project is a common struct used in several types.
+type Project struct {
+	Key    string `json:"key"`
+	ID     int    `json:"id"`
+	Name   string `json:"name"`
+	Public bool   `json:"public"`
+	Type   string `json:"type"`
+}
+
+// Repository is a common struct used in several types.
+type Repository struct {
+	Slug          string      `json:"slug"`
+	ID            int         `json:"id"`
+	Name          string      `json:"name"`
+	ScmID         string      `json:"scmId"`
+	State         string      `json:"state"`
+	StatusMessage string      `json:"statusMessage"`
+	Forkable      bool        `json:"forkable"`
+	Project       Project     `json:"project"`
+	Public        bool        `json:"public"`
+	Origin        *Repository `json:"origin,omitempty"`
+}
+
+// RepositoryChange describes a single ref update, as found in RepoRefsChangedEvent.
+type RepositoryChange struct {
+	Ref struct {
+		ID        string `json:"id"`
+		DisplayID string `json:"displayId"`
+		Type      string `json:"type"`
+	} `json:"ref"`
+	RefID    string `json:"refId"`
+	FromHash string `json:"fromHash"`
+	ToHash   string `json:"toHash"`
+	Type     string `json:"type"`
+}
+
+// DiagnosticsPingEvent https://confluence.atlassian.com/bitbucketserver/event-payload-938025882.html#Eventpayload-Webhooktest:ping
+// is sent when a webhook is tested from the admin UI.
+type DiagnosticsPingEvent struct {
+	Test bool `json:"test"`
+}
+
+// RepoRefsChangedEvent https://confluence.atlassian.com/bitbucketserver/event-payload-938025882.html#Eventpayload-Push
+type RepoRefsChangedEvent struct {
+	EventKey   string             `json:"eventKey"`
+	Date       Timestamp          `json:"date"`
+	Actor      Actor              `json:"actor"`
+	Repository Repository         `json:"repository"`
+	Changes    []RepositoryChange `json:"changes"`
+}
+
+// RepoModifiedEvent https://confluence.atlassian.com/bitbucketserver/event-payload-938025882.html#Eventpayload-Modified
+type RepoModifiedEvent struct {
+	EventKey string     `json:"eventKey"`
+	Date     Timestamp  `json:"date"`
+	Actor    Actor      `json:"actor"`
+	Old      Repository `json:"old"`
+	New      Repository `json:"new"`
+}
+
+// RepoForkedEvent https://confluence.atlassian.com/bitbucketserver/event-payload-938025882.html#Eventpayload-Forked
+// The forked repository is returned in Repository, which carries the
+// original repository in its Origin field.
+type RepoForkedEvent struct {
+	EventKey   string     `json:"eventKey"`
+	Date       Timestamp  `json:"date"`
+	Actor      Actor      `json:"actor"`
+	Repository Repository `json:"repository"`
+}
+
+// Comment https://confluence.atlassian.com/bitbucketserver/event-payload-938025882.html#Eventpayload-entity_comment
+type Comment struct {
+	ID          int       `json:"id"`
+	Version     int       `json:"version"`
+	Text        string    `json:"text"`
+	Author      Actor     `json:"author"`
+	CreatedDate Timestamp `json:"createdDate"`
+	UpdatedDate Timestamp `json:"updatedDate"`
+	Comments    []Comment `json:"comments"`
+}
+
+// A RepoCommentEvent is not a BB event. This is the base for the repo:comment:* events.
+type RepoCommentEvent struct {
+	EventKey   string     `json:"eventKey"`
+	Date       Timestamp  `json:"date"`
+	Actor      Actor      `json:"actor"`
+	Repository Repository `json:"repository"`
+	Commit     string     `json:"commit"`
+	Comment    Comment    `json:"comment"`
+}
+
+// RepoCommentAddedEvent https://confluence.atlassian.com/bitbucketserver/event-payload-938025882.html#Eventpayload-CommentAdded
+type RepoCommentAddedEvent struct {
+	RepoCommentEvent
+}
+
+// RepoCommentEditedEvent https://confluence.atlassian.com/bitbucketserver/event-payload-938025882.html#Eventpayload-CommentEdited
+type RepoCommentEditedEvent struct {
+	RepoCommentEvent
+	PreviousComment string `json:"previousComment"`
+}
+
+// RepoCommentDeletedEvent https://confluence.atlassian.com/bitbucketserver/event-payload-938025882.html#Eventpayload-CommentDeleted
+type RepoCommentDeletedEvent struct {
+	RepoCommentEvent
+}
+
+// PullRequestRef identifies a branch and the repository it lives in, as used
+// for a pull request's FromRef/ToRef and PreviousTarget.
+type PullRequestRef struct {
+	ID           string     `json:"id"`
+	DisplayID    string     `json:"displayId"`
+	LatestCommit string     `json:"latestCommit"`
+	Repository   Repository `json:"repository"`
+}
+
+// PullRequestParticipant https://confluence.atlassian.com/bitbucketserver/event-payload-938025882.html#Eventpayload-entity_participant
+type PullRequestParticipant struct {
+	User     Actor  `json:"user"`
+	Role     string `json:"role"`
+	Approved bool   `json:"approved"`
+	Status   string `json:"status"`
+}
+
+// PullRequest https://confluence.atlassian.com/bitbucketserver/event-payload-938025882.html#Eventpayload-entity_pullrequest
+type PullRequest struct {
+	ID           int                      `json:"id"`
+	Version      int                      `json:"version"`
+	Title        string                   `json:"title"`
+	Description  string                   `json:"description"`
+	State        string                   `json:"state"`
+	Open         bool                     `json:"open"`
+	Closed       bool                     `json:"closed"`
+	CreatedDate  Timestamp                `json:"createdDate"`
+	UpdatedDate  Timestamp                `json:"updatedDate"`
+	FromRef      PullRequestRef           `json:"fromRef"`
+	ToRef        PullRequestRef           `json:"toRef"`
+	Locked       bool                     `json:"locked"`
+	Author       PullRequestParticipant   `json:"author"`
+	Reviewers    []PullRequestParticipant `json:"reviewers"`
+	Participants []PullRequestParticipant `json:"participants"`
+}
+
+// A PullRequestEvent is not a BB event. This is the base for every pr:* event.
+type PullRequestEvent struct {
+	EventKey    string      `json:"eventKey"`
+	Date        Timestamp   `json:"date"`
+	Actor       Actor       `json:"actor"`
+	PullRequest PullRequest `json:"pullRequest"`
+}
+
+// PullRequestOpenedEvent https://confluence.atlassian.com/bitbucketserver/event-payload-938025882.html#Eventpayload-Opened
+type PullRequestOpenedEvent struct {
+	PullRequestEvent
+}
+
+// PullRequestFromRefUpdatedEvent https://confluence.atlassian.com/bitbucketserver/event-payload-938025882.html#Eventpayload-SourcebranchupdatedSourcebranchupdated
+type PullRequestFromRefUpdatedEvent struct {
+	PullRequestEvent
+	PreviousFromHash string `json:"previousFromHash"`
+}
+
+// PullRequestModifiedEvent https://confluence.atlassian.com/bitbucketserver/event-payload-938025882.html#Eventpayload-Modified.1
+type PullRequestModifiedEvent struct {
+	PullRequestEvent
+	PreviousTitle       string         `json:"previousTitle"`
+	PreviousDescription string         `json:"previousDescription"`
+	PreviousTarget      PullRequestRef `json:"previousTarget"`
+}
+
+// A PullRequestReviewerEvent is not a BB event. This is the base for the pr:reviewer:* events.
+type PullRequestReviewerEvent struct {
+	PullRequestEvent
+	Participant PullRequestParticipant `json:"participant"`
+}
+
+// PullRequestReviewerApprovedEvent https://confluence.atlassian.com/bitbucketserver/event-payload-938025882.html#Eventpayload-Approved
+type PullRequestReviewerApprovedEvent struct {
+	PullRequestReviewerEvent
+}
+
+// PullRequestReviewerUnapprovedEvent https://confluence.atlassian.com/bitbucketserver/event-payload-938025882.html#Eventpayload-Unapproved
+type PullRequestReviewerUnapprovedEvent struct {
+	PullRequestReviewerEvent
+}
+
+// PullRequestReviewerNeedsWorkEvent https://confluence.atlassian.com/bitbucketserver/event-payload-938025882.html#Eventpayload-Needswork
+type PullRequestReviewerNeedsWorkEvent struct {
+	PullRequestReviewerEvent
+}
+
+// PullRequestReviewerUpdatedEvent https://confluence.atlassian.com/bitbucketserver/event-payload-938025882.html#Eventpayload-ReviewersUpdated
+type PullRequestReviewerUpdatedEvent struct {
+	PullRequestEvent
+	AddedReviewers   []Actor `json:"addedReviewers"`
+	RemovedReviewers []Actor `json:"removedReviewers"`
+}
+
+// PullRequestMergedEvent https://confluence.atlassian.com/bitbucketserver/event-payload-938025882.html#Eventpayload-Merged
+type PullRequestMergedEvent struct {
+	PullRequestEvent
+}
+
+// PullRequestDeclinedEvent https://confluence.atlassian.com/bitbucketserver/event-payload-938025882.html#Eventpayload-Declined
+type PullRequestDeclinedEvent struct {
+	PullRequestEvent
+}
+
+// PullRequestDeletedEvent https://confluence.atlassian.com/bitbucketserver/event-payload-938025882.html#Eventpayload-Deleted
+type PullRequestDeletedEvent struct {
+	PullRequestEvent
+}
+
+// A PullRequestCommentEvent is not a BB event. This is the base for the pr:comment:* events.
+type PullRequestCommentEvent struct {
+	PullRequestEvent
+	Comment Comment `json:"comment"`
+}
+
+// PullRequestCommentAddedEvent https://confluence.atlassian.com/bitbucketserver/event-payload-938025882.html#Eventpayload-CommentAdded.1
+type PullRequestCommentAddedEvent struct {
+	PullRequestCommentEvent
+}
+
+// PullRequestCommentEditedEvent https://confluence.atlassian.com/bitbucketserver/event-payload-938025882.html#Eventpayload-CommentEdited.1
+type PullRequestCommentEditedEvent struct {
+	PullRequestCommentEvent
+	PreviousComment string `json:"previousComment"`
+}
+
+// PullRequestCommentDeletedEvent https://confluence.atlassian.com/bitbucketserver/event-payload-938025882.html#Eventpayload-CommentDeleted.1
+type PullRequestCommentDeletedEvent struct {
+	PullRequestCommentEvent
+}
@@ -0,0 +1,175 @@
+package bitbucketserver
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"reflect"
+	"strings"
+)
+
+// Headers is a map that contains the event payload headers set by Bitbucket Server.
+// See: https://confluence.atlassian.com/bitbucketserver/event-payload-938025882.html#Eventpayload-HTTPheaders
+type Headers map[string]string
+
+// A WebhookHandler defined the function signature for event handler callbacks.
+// Use type assertions to access the associated event type. The type of event is
+// always a pointer to the event struct. WebhookHandlers normally return nil
+// but can return an error which triggers a 400 Bad Request response.
+type WebhookHandler func(headers Headers, event interface{}) error
+
+// Webhook is a http.Handler that parses Bitbucket Server webhook events, mapping
+// them to the appropriate event type and calling event handlers.
+type Webhook struct {
+
+	// LogOnError is an optional callback called when logging errors
+	LogOnError func(format string, a ...interface{})
+
+	handlers map[string]WebhookHandler
+	secret   []byte
+}
+
+// NewWebhook constructs a new Webhook.
+func NewWebhook() *Webhook {
+	return &Webhook{
+		handlers: map[string]WebhookHandler{},
+	}
+}
+
+// map of webhook events to the payload type
+var eventTypeMap = map[string]interface{}{
+	"diagnostics:ping":       DiagnosticsPingEvent{},
+	"repo:refs_changed":      RepoRefsChangedEvent{},
+	"repo:modified":          RepoModifiedEvent{},
+	"repo:forked":            RepoForkedEvent{},
+	"repo:comment:added":     RepoCommentAddedEvent{},
+	"repo:comment:edited":    RepoCommentEditedEvent{},
+	"repo:comment:deleted":   RepoCommentDeletedEvent{},
+	"pr:opened":              PullRequestOpenedEvent{},
+	"pr:from_ref_updated":    PullRequestFromRefUpdatedEvent{},
+	"pr:modified":            PullRequestModifiedEvent{},
+	"pr:reviewer:approved":   PullRequestReviewerApprovedEvent{},
+	"pr:reviewer:unapproved": PullRequestReviewerUnapprovedEvent{},
+	"pr:reviewer:needs_work": PullRequestReviewerNeedsWorkEvent{},
+	"pr:reviewer:updated":    PullRequestReviewerUpdatedEvent{},
+	"pr:merged":              PullRequestMergedEvent{},
+	"pr:declined":            PullRequestDeclinedEvent{},
+	"pr:deleted":             PullRequestDeletedEvent{},
+	"pr:comment:added":       PullRequestCommentAddedEvent{},
+	"pr:comment:edited":      PullRequestCommentEditedEvent{},
+	"pr:comment:deleted":     PullRequestCommentDeletedEvent{},
+}
+
+// SetSecret configures the shared secret Bitbucket Server signs the webhook
+// body with. When set, ServeHTTP verifies the `X-Hub-Signature: sha256=<hex>`
+// header on every request and rejects requests that don't match with a 401.
+func (wh *Webhook) SetSecret(secret string) {
+	wh.secret = []byte(secret)
+}
+
+// ServeHTTP implements the http.Handler interface. It extracts the request
+// headers, maps the event key to the correct payload event type, parses the
+// JSON payload and calls the registered WebHookHandler passing the headers and
+// event type. A 400 Bad Request response is sent for any request made to
+// an event that doesn't have a registered handler. If SetSecret has been
+// called, requests with a missing or invalid signature get a 401 Unauthorized
+// response instead.
+func (wh *Webhook) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	headers := Headers{}
+	for _, header := range []string{"X-Event-Key", "X-Request-Id", "X-Hub-Signature"} {
+		headers[header] = r.Header.Get(header)
+	}
+
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		log.Printf("Error reading the body: %s", err)
+		http.Error(w, "Read error: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if len(wh.secret) > 0 {
+		if !validSignature(wh.secret, body, headers["X-Hub-Signature"]) {
+			wh.unauthorized(w, r, "Invalid X-Hub-Signature")
+			return
+		}
+	}
+
+	eventKey := headers["X-Event-Key"]
+	if eventKey == "" {
+		wh.badRequest(w, r, "Missing X-Event-Key")
+		return
+	}
+
+	handler, ok := wh.handlers[eventKey]
+	if !ok {
+		wh.badRequest(w, r, "No handler for the event key: %s", eventKey)
+		return
+	}
+
+	t, ok := eventTypeMap[eventKey]
+	if !ok {
+		wh.badRequest(w, r, "Unsupported event key type: %s", eventKey)
+		return
+	}
+
+	event := reflect.New(reflect.TypeOf(t)).Elem().Addr().Interface()
+	err = json.NewDecoder(bytes.NewReader(body)).Decode(event)
+	if err != nil {
+		log.Printf("Error parsing the body: %s", err)
+		http.Error(w, "Read error: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	err = handler(headers, event)
+	if err != nil {
+		wh.badRequest(w, r, "Error handling the event: %s", err)
+		return
+	}
+
+}
+
+// validSignature reports whether sig (the raw `X-Hub-Signature` header value,
+// e.g. "sha256=abcd...") is the HMAC-SHA256 of body using secret.
+func validSignature(secret, body []byte, sig string) bool {
+	const prefix = "sha256="
+	if !strings.HasPrefix(sig, prefix) {
+		return false
+	}
+
+	expected, err := hex.DecodeString(strings.TrimPrefix(sig, prefix))
+	if err != nil {
+		return false
+	}
+
+	mac := hmac.New(sha256.New, secret)
+	mac.Write(body)
+	return hmac.Equal(expected, mac.Sum(nil))
+}
+
+// Handle is called to register a webhook handler for the expected eventKey. See
+// the Bitbucket Server docs for all the possible event keys.
+func (wh *Webhook) Handle(eventKey string, handler WebhookHandler) {
+	wh.handlers[eventKey] = handler
+}
+
+func (wh *Webhook) badRequest(w http.ResponseWriter, r *http.Request, msg string, p ...interface{}) {
+	fmsg := fmt.Sprintf(msg, p...)
+	if wh.LogOnError != nil {
+		wh.LogOnError(fmsg)
+	}
+	http.Error(w, fmsg, http.StatusBadRequest)
+}
+
+func (wh *Webhook) unauthorized(w http.ResponseWriter, r *http.Request, msg string, p ...interface{}) {
+	fmsg := fmt.Sprintf(msg, p...)
+	if wh.LogOnError != nil {
+		wh.LogOnError(fmsg)
+	}
+	http.Error(w, fmsg, http.StatusUnauthorized)
+}
@@ -0,0 +1,286 @@
+package bitbucketserver
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestNew(t *testing.T) {
+	wh := NewWebhook()
+	assert.NotNil(t, wh)
+	assert.IsType(t, &Webhook{}, wh)
+}
+
+func TestEvents(t *testing.T) {
+	wh := NewWebhook()
+
+	type fixture struct {
+		event       string
+		handler     WebhookHandler
+		payloadFile string
+	}
+	for _, fix := range []fixture{
+
+		{"diagnostics:ping", func(h Headers, e interface{}) error {
+			ping := e.(*DiagnosticsPingEvent)
+			assert.True(t, ping.Test)
+			return nil
+		}, "diagnostics_ping_event.json"},
+
+		{"repo:refs_changed", func(h Headers, e interface{}) error {
+			rc := e.(*RepoRefsChangedEvent)
+			assert.Equal(t, "test-repo", rc.Repository.Name)
+			require.Len(t, rc.Changes, 1)
+			assert.Equal(t, "refs/heads/master", rc.Changes[0].RefID)
+			assert.Equal(t, "d3022fc", rc.Changes[0].ToHash)
+			return nil
+		}, "repo_refs_changed_event.json"},
+
+		{"repo:modified", func(h Headers, e interface{}) error {
+			rm := e.(*RepoModifiedEvent)
+			assert.Equal(t, "test-repo", rm.Old.Name)
+			assert.Equal(t, "test-repo-renamed", rm.New.Name)
+			return nil
+		}, "repo_modified_event.json"},
+
+		{"repo:forked", func(h Headers, e interface{}) error {
+			rf := e.(*RepoForkedEvent)
+			assert.Equal(t, "test-repo-fork", rf.Repository.Name)
+			require.NotNil(t, rf.Repository.Origin)
+			assert.Equal(t, "test-repo", rf.Repository.Origin.Name)
+			return nil
+		}, "repo_forked_event.json"},
+
+		{"repo:comment:added", func(h Headers, e interface{}) error {
+			rc := e.(*RepoCommentAddedEvent)
+			assert.Equal(t, "This is a commit comment", rc.Comment.Text)
+			return nil
+		}, "repo_comment_added_event.json"},
+
+		{"repo:comment:edited", func(h Headers, e interface{}) error {
+			rc := e.(*RepoCommentEditedEvent)
+			assert.Equal(t, "This is an edited commit comment", rc.Comment.Text)
+			assert.Equal(t, "This is a commit comment", rc.PreviousComment)
+			return nil
+		}, "repo_comment_edited_event.json"},
+
+		{"repo:comment:deleted", func(h Headers, e interface{}) error {
+			rc := e.(*RepoCommentDeletedEvent)
+			assert.Equal(t, "This comment was deleted", rc.Comment.Text)
+			return nil
+		}, "repo_comment_deleted_event.json"},
+
+		{"pr:opened", func(h Headers, e interface{}) error {
+			pr := e.(*PullRequestOpenedEvent)
+			assert.Equal(t, "Add a new feature", pr.PullRequest.Title)
+			assert.Equal(t, "OPEN", pr.PullRequest.State)
+			return nil
+		}, "pr_opened_event.json"},
+
+		{"pr:from_ref_updated", func(h Headers, e interface{}) error {
+			pr := e.(*PullRequestFromRefUpdatedEvent)
+			assert.Equal(t, "d3022fc", pr.PreviousFromHash)
+			assert.Equal(t, "e4f5a6b", pr.PullRequest.FromRef.LatestCommit)
+			return nil
+		}, "pr_from_ref_updated_event.json"},
+
+		{"pr:modified", func(h Headers, e interface{}) error {
+			pr := e.(*PullRequestModifiedEvent)
+			assert.Equal(t, "Add a new feature, updated", pr.PullRequest.Title)
+			assert.Equal(t, "Add a new feature", pr.PreviousTitle)
+			return nil
+		}, "pr_modified_event.json"},
+
+		{"pr:reviewer:approved", func(h Headers, e interface{}) error {
+			pr := e.(*PullRequestReviewerApprovedEvent)
+			assert.Equal(t, "reviewer", pr.Participant.User.Name)
+			assert.True(t, pr.Participant.Approved)
+			return nil
+		}, "pr_reviewer_approved_event.json"},
+
+		{"pr:reviewer:unapproved", func(h Headers, e interface{}) error {
+			pr := e.(*PullRequestReviewerUnapprovedEvent)
+			assert.Equal(t, "reviewer", pr.Participant.User.Name)
+			assert.False(t, pr.Participant.Approved)
+			return nil
+		}, "pr_reviewer_unapproved_event.json"},
+
+		{"pr:reviewer:needs_work", func(h Headers, e interface{}) error {
+			pr := e.(*PullRequestReviewerNeedsWorkEvent)
+			assert.Equal(t, "NEEDS_WORK", pr.Participant.Status)
+			return nil
+		}, "pr_reviewer_needs_work_event.json"},
+
+		{"pr:reviewer:updated", func(h Headers, e interface{}) error {
+			pr := e.(*PullRequestReviewerUpdatedEvent)
+			require.Len(t, pr.AddedReviewers, 1)
+			assert.Equal(t, "reviewer", pr.AddedReviewers[0].Name)
+			require.Len(t, pr.RemovedReviewers, 1)
+			assert.Equal(t, "other-reviewer", pr.RemovedReviewers[0].Name)
+			return nil
+		}, "pr_reviewer_updated_event.json"},
+
+		{"pr:merged", func(h Headers, e interface{}) error {
+			pr := e.(*PullRequestMergedEvent)
+			assert.Equal(t, "MERGED", pr.PullRequest.State)
+			assert.Equal(t, "f6e5d4c", pr.PullRequest.FromRef.LatestCommit)
+			return nil
+		}, "pr_merged_event.json"},
+
+		{"pr:declined", func(h Headers, e interface{}) error {
+			pr := e.(*PullRequestDeclinedEvent)
+			assert.Equal(t, "DECLINED", pr.PullRequest.State)
+			return nil
+		}, "pr_declined_event.json"},
+
+		{"pr:deleted", func(h Headers, e interface{}) error {
+			pr := e.(*PullRequestDeletedEvent)
+			assert.Equal(t, 1, pr.PullRequest.ID)
+			return nil
+		}, "pr_deleted_event.json"},
+
+		{"pr:comment:added", func(h Headers, e interface{}) error {
+			prc := e.(*PullRequestCommentAddedEvent)
+			assert.Equal(t, "This is a pull request comment", prc.Comment.Text)
+			return nil
+		}, "pr_comment_added_event.json"},
+
+		{"pr:comment:edited", func(h Headers, e interface{}) error {
+			prc := e.(*PullRequestCommentEditedEvent)
+			assert.Equal(t, "This is an edited pull request comment", prc.Comment.Text)
+			assert.Equal(t, "This is a pull request comment", prc.PreviousComment)
+			return nil
+		}, "pr_comment_edited_event.json"},
+
+		{"pr:comment:deleted", func(h Headers, e interface{}) error {
+			prc := e.(*PullRequestCommentDeletedEvent)
+			assert.Equal(t, "This comment was deleted", prc.Comment.Text)
+			return nil
+		}, "pr_comment_deleted_event.json"},
+	} {
+		called := false
+		wh.Handle(fix.event, func(h Headers, e interface{}) error {
+			called = true
+			return fix.handler(h, e)
+		})
+
+		jsn, err := ioutil.ReadFile("fixtures/" + fix.payloadFile)
+		require.Nil(t, err)
+
+		rec := httptest.NewRecorder()
+		req, err := http.NewRequest("POST", "http://example.com", bytes.NewReader(jsn))
+		require.Nil(t, err)
+		req.Header.Add("X-Event-Key", fix.event)
+
+		log.Println("Test event:", fix.event)
+		wh.ServeHTTP(rec, req)
+
+		require.Equal(t, http.StatusOK, rec.Code)
+		require.True(t, called, "Event is called: "+fix.event)
+	}
+}
+
+func TestSignatureVerification(t *testing.T) {
+	secret := "shhh"
+	jsn, err := ioutil.ReadFile("fixtures/diagnostics_ping_event.json")
+	require.Nil(t, err)
+
+	sign := func(body []byte) string {
+		mac := hmac.New(sha256.New, []byte(secret))
+		mac.Write(body)
+		return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+	}
+
+	t.Run("valid signature is accepted", func(t *testing.T) {
+		wh := NewWebhook()
+		wh.SetSecret(secret)
+		wh.Handle("diagnostics:ping", func(h Headers, e interface{}) error {
+			return nil
+		})
+
+		rec := httptest.NewRecorder()
+		req, err := http.NewRequest("POST", "http://example.com", bytes.NewReader(jsn))
+		require.Nil(t, err)
+		req.Header.Add("X-Event-Key", "diagnostics:ping")
+		req.Header.Add("X-Hub-Signature", sign(jsn))
+
+		wh.ServeHTTP(rec, req)
+		require.Equal(t, http.StatusOK, rec.Code)
+	})
+
+	t.Run("tampered body is rejected", func(t *testing.T) {
+		wh := NewWebhook()
+		wh.SetSecret(secret)
+		wh.Handle("diagnostics:ping", func(h Headers, e interface{}) error {
+			return nil
+		})
+
+		rec := httptest.NewRecorder()
+		req, err := http.NewRequest("POST", "http://example.com", bytes.NewReader(append(jsn, ' ')))
+		require.Nil(t, err)
+		req.Header.Add("X-Event-Key", "diagnostics:ping")
+		req.Header.Add("X-Hub-Signature", sign(jsn))
+
+		wh.ServeHTTP(rec, req)
+		require.Equal(t, http.StatusUnauthorized, rec.Code)
+	})
+
+	t.Run("missing sha256 prefix is rejected", func(t *testing.T) {
+		wh := NewWebhook()
+		wh.SetSecret(secret)
+		wh.Handle("diagnostics:ping", func(h Headers, e interface{}) error {
+			return nil
+		})
+
+		rec := httptest.NewRecorder()
+		req, err := http.NewRequest("POST", "http://example.com", bytes.NewReader(jsn))
+		require.Nil(t, err)
+		req.Header.Add("X-Event-Key", "diagnostics:ping")
+		req.Header.Add("X-Hub-Signature", hex.EncodeToString([]byte("not-prefixed")))
+
+		wh.ServeHTTP(rec, req)
+		require.Equal(t, http.StatusUnauthorized, rec.Code)
+	})
+
+	t.Run("invalid hex is rejected", func(t *testing.T) {
+		wh := NewWebhook()
+		wh.SetSecret(secret)
+		wh.Handle("diagnostics:ping", func(h Headers, e interface{}) error {
+			return nil
+		})
+
+		rec := httptest.NewRecorder()
+		req, err := http.NewRequest("POST", "http://example.com", bytes.NewReader(jsn))
+		require.Nil(t, err)
+		req.Header.Add("X-Event-Key", "diagnostics:ping")
+		req.Header.Add("X-Hub-Signature", "sha256=not-hex")
+
+		wh.ServeHTTP(rec, req)
+		require.Equal(t, http.StatusUnauthorized, rec.Code)
+	})
+
+	t.Run("no secret configured skips verification", func(t *testing.T) {
+		wh := NewWebhook()
+		wh.Handle("diagnostics:ping", func(h Headers, e interface{}) error {
+			return nil
+		})
+
+		rec := httptest.NewRecorder()
+		req, err := http.NewRequest("POST", "http://example.com", bytes.NewReader(jsn))
+		require.Nil(t, err)
+		req.Header.Add("X-Event-Key", "diagnostics:ping")
+
+		wh.ServeHTTP(rec, req)
+		require.Equal(t, http.StatusOK, rec.Code)
+	})
+}
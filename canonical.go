@@ -0,0 +1,196 @@
+package bitbucket
+
+import "fmt"
+
+// EventKind identifies the kind of entity a CanonicalEvent describes,
+// independent of which specific Bitbucket event key produced it.
+type EventKind int
+
+// The EventKind values recognized by ToCanonical.
+const (
+	KindRepository EventKind = iota
+	KindIssue
+	KindPullRequest
+)
+
+// String returns a human readable name for the EventKind.
+func (k EventKind) String() string {
+	switch k {
+	case KindRepository:
+		return "repository"
+	case KindIssue:
+		return "issue"
+	case KindPullRequest:
+		return "pull_request"
+	default:
+		return "unknown"
+	}
+}
+
+// Action identifies what happened to the entity behind a CanonicalEvent,
+// independent of which specific Bitbucket event key produced it. Several
+// event keys can map to the same Action, e.g. `repo:commit_status_created`,
+// `repo:commit_status_updated` and `repo:updated` all map to ActionUpdate.
+// Both `pullrequest:fulfilled` and `pullrequest:rejected` leave a pull
+// request no longer open, but only the latter maps to ActionClose.
+type Action int
+
+// The Action values recognized by ToCanonical.
+const (
+	ActionUnknown Action = iota
+	ActionOpen
+	ActionSync
+	ActionUpdate
+	ActionMerge
+	ActionClose
+	ActionApprove
+	ActionUnapprove
+	ActionCommentCreate
+	ActionCommentUpdate
+	ActionCommentDelete
+	ActionFork
+	ActionPush
+)
+
+// String returns a human readable name for the Action.
+func (a Action) String() string {
+	switch a {
+	case ActionOpen:
+		return "open"
+	case ActionSync:
+		return "sync"
+	case ActionUpdate:
+		return "update"
+	case ActionMerge:
+		return "merge"
+	case ActionClose:
+		return "close"
+	case ActionApprove:
+		return "approve"
+	case ActionUnapprove:
+		return "unapprove"
+	case ActionCommentCreate:
+		return "comment_create"
+	case ActionCommentUpdate:
+		return "comment_update"
+	case ActionCommentDelete:
+		return "comment_delete"
+	case ActionFork:
+		return "fork"
+	case ActionPush:
+		return "push"
+	default:
+		return "unknown"
+	}
+}
+
+// CanonicalEvent is a neutral view over the concrete, event-specific payload
+// types, letting callers route on "what kind of thing changed" and "what
+// happened to it" without switching on every individual event key. It is
+// produced by ToCanonical from an event key and the already-decoded payload
+// returned by Parse.
+type CanonicalEvent interface {
+	// Kind reports the kind of entity the event is about.
+	Kind() EventKind
+	// Actor is the user that triggered the event.
+	Actor() Actor
+	// Repo is the repository the event happened in.
+	Repo() Repository
+	// Action reports what happened to the entity, e.g. ActionMerge.
+	Action() Action
+}
+
+// canonicalEvent is the concrete CanonicalEvent implementation returned by
+// ToCanonical.
+type canonicalEvent struct {
+	kind   EventKind
+	action Action
+	actor  Actor
+	repo   Repository
+}
+
+func (c canonicalEvent) Kind() EventKind  { return c.kind }
+func (c canonicalEvent) Actor() Actor     { return c.actor }
+func (c canonicalEvent) Repo() Repository { return c.repo }
+func (c canonicalEvent) Action() Action   { return c.action }
+
+// eventKindActions maps every event key in eventTypeMap to its EventKind and
+// Action.
+var eventKindActions = map[string]struct {
+	kind   EventKind
+	action Action
+}{
+	"repo:push":                    {KindRepository, ActionPush},
+	"repo:fork":                    {KindRepository, ActionFork},
+	"repo:commit_comment_created":  {KindRepository, ActionCommentCreate},
+	"repo:commit_status_created":   {KindRepository, ActionUpdate},
+	"repo:commit_status_updated":   {KindRepository, ActionUpdate},
+	"repo:updated":                 {KindRepository, ActionUpdate},
+	"issue:created":                {KindIssue, ActionOpen},
+	"issue:updated":                {KindIssue, ActionSync},
+	"issue:comment_created":        {KindIssue, ActionCommentCreate},
+	"pullrequest:created":          {KindPullRequest, ActionOpen},
+	"pullrequest:updated":          {KindPullRequest, ActionSync},
+	"pullrequest:approved":         {KindPullRequest, ActionApprove},
+	"pullrequest:unapproved":       {KindPullRequest, ActionUnapprove},
+	"pullrequest:fulfilled":        {KindPullRequest, ActionMerge},
+	"pullrequest:rejected":         {KindPullRequest, ActionClose},
+	"pullrequest:comment_created":  {KindPullRequest, ActionCommentCreate},
+	"pullrequest:comment_updated":  {KindPullRequest, ActionCommentUpdate},
+	"pull_request:comment_deleted": {KindPullRequest, ActionCommentDelete},
+}
+
+// ToCanonical builds a CanonicalEvent for eventKey out of event, the typed
+// payload returned by Parse for that same eventKey. It returns
+// ErrEventNotFound if eventKey isn't recognized.
+func ToCanonical(eventKey string, event interface{}) (CanonicalEvent, error) {
+	ka, ok := eventKindActions[eventKey]
+	if !ok {
+		return nil, ErrEventNotFound
+	}
+
+	var actor Actor
+	var repo Repository
+	switch e := event.(type) {
+	case *RepoPushEvent:
+		actor, repo = e.Actor, e.Repository
+	case *RepoForkEvent:
+		actor, repo = e.Actor, e.Repository
+	case *RepoCommitCommentCreatedEvent:
+		actor, repo = e.Actor, e.Repository
+	case *RepoCommitStatusCreatedEvent:
+		actor, repo = e.Actor, e.Repository
+	case *RepoCommitStatusUpdatedEvent:
+		actor, repo = e.Actor, e.Repository
+	case *RepoUpdatedEvent:
+		actor, repo = e.Actor, e.Repository
+	case *IssueCreatedEvent:
+		actor, repo = e.Actor, e.Repository
+	case *IssueUpdatedEvent:
+		actor, repo = e.Actor, e.Repository
+	case *IssueCommentCreatedEvent:
+		actor, repo = e.Actor, e.Repository
+	case *PullRequestCreatedEvent:
+		actor, repo = e.Actor, e.Repository
+	case *PullRequestUpdatedEvent:
+		actor, repo = e.Actor, e.Repository
+	case *PullRequestApprovedEvent:
+		actor, repo = e.Actor, e.Repository
+	case *PullRequestApprovalRemovedEvent:
+		actor, repo = e.Actor, e.Repository
+	case *PullRequestMergedEvent:
+		actor, repo = e.Actor, e.Repository
+	case *PullRequestDeclinedEvent:
+		actor, repo = e.Actor, e.Repository
+	case *PullRequestCommentCreatedEvent:
+		actor, repo = e.Actor, e.Repository
+	case *PullRequestCommentUpdatedEvent:
+		actor, repo = e.Actor, e.Repository
+	case *PullRequestCommentDeletedEvent:
+		actor, repo = e.Actor, e.Repository
+	default:
+		return nil, fmt.Errorf("bitbucket: unsupported event type for %s: %T", eventKey, event)
+	}
+
+	return canonicalEvent{kind: ka.kind, action: ka.action, actor: actor, repo: repo}, nil
+}
@@ -241,6 +241,38 @@ type Issue struct {
 	Links     Links      `json:"links"`
 }
 
+// RepoUpdatedEvent https://confluence.atlassian.com/bitbucket/event-payloads-740262817.html#EventPayloads-Updated
+type RepoUpdatedEvent struct {
+	Actor      Actor      `json:"actor"`
+	Repository Repository `json:"repository"`
+	Changes    struct {
+		Name struct {
+			Old string `json:"old"`
+			New string `json:"new"`
+		} `json:"name"`
+		Website struct {
+			Old string `json:"old"`
+			New string `json:"new"`
+		} `json:"website"`
+		Language struct {
+			Old string `json:"old"`
+			New string `json:"new"`
+		} `json:"language"`
+		Links struct {
+			Old Links `json:"old"`
+			New Links `json:"new"`
+		} `json:"links"`
+		Description struct {
+			Old string `json:"old"`
+			New string `json:"new"`
+		} `json:"description"`
+		IsPrivate struct {
+			Old bool `json:"old"`
+			New bool `json:"new"`
+		} `json:"is_private"`
+	} `json:"changes"`
+}
+
 // A PullRequestEvent is not a BB event. This is the base for several PullRequest* events.
 type PullRequestEvent struct {
 	Actor       Actor       `json:"actor"`
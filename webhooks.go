@@ -8,11 +8,33 @@
 package bitbucket
 
 import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"io/ioutil"
 	"log"
 	"net/http"
 	"reflect"
+	"strings"
+	"sync"
+)
+
+// Sentinel errors returned by Parse.
+var (
+	// ErrInvalidHTTPMethod is returned when the request method isn't POST.
+	ErrInvalidHTTPMethod = errors.New("bitbucket: invalid HTTP method, expected POST")
+	// ErrMissingEventKeyHeader is returned when the X-Event-Key header is absent or empty.
+	ErrMissingEventKeyHeader = errors.New("bitbucket: missing X-Event-Key header")
+	// ErrEventNotFound is returned when the event key isn't in the caller-supplied
+	// allowlist, or has no known payload type.
+	ErrEventNotFound = errors.New("bitbucket: event key not found")
+	// ErrParsingPayload is returned when the JSON body can't be decoded into the event type.
+	ErrParsingPayload = errors.New("bitbucket: error parsing the payload")
 )
 
 // Headers is a map that contains the event payload headers set by BitBucket.
@@ -32,7 +54,50 @@ type Webhook struct {
 	// LogOnError is an optional callback called when logging errors
 	LogOnError func(format string, a ...interface{})
 
-	handlers map[string]WebhookHandler
+	handlers     map[string]WebhookHandler
+	secret       []byte
+	expectedUUID string
+
+	anyHandler   CanonicalHandler
+	kindHandlers []kindHandler
+
+	mu           sync.Mutex
+	queue        chan asyncJob
+	shuttingDown bool
+	shutdownOnce sync.Once
+	drained      chan struct{}
+	inFlight     sync.WaitGroup
+	workers      sync.WaitGroup
+	retryPolicy  RetryPolicy
+	deadLetter   DeadLetter
+}
+
+// A CanonicalHandler is called for events dispatched through HandleAny or
+// HandleKind. It receives the request headers and the CanonicalEvent built
+// from the underlying, event-specific payload.
+type CanonicalHandler func(headers Headers, event CanonicalEvent) error
+
+// kindHandler pairs a CanonicalHandler with the EventKind and, optionally,
+// the subset of Actions it should be called for.
+type kindHandler struct {
+	kind    EventKind
+	actions []Action
+	handler CanonicalHandler
+}
+
+func (kh kindHandler) matches(kind EventKind, action Action) bool {
+	if kh.kind != kind {
+		return false
+	}
+	if len(kh.actions) == 0 {
+		return true
+	}
+	for _, a := range kh.actions {
+		if a == action {
+			return true
+		}
+	}
+	return false
 }
 
 // NewWebhook constructs a new Webhook.
@@ -49,6 +114,7 @@ var eventTypeMap = map[string]interface{}{
 	"repo:commit_comment_created":  RepoCommitCommentCreatedEvent{},
 	"repo:commit_status_created":   RepoCommitStatusCreatedEvent{},
 	"repo:commit_status_updated":   RepoCommitStatusUpdatedEvent{},
+	"repo:updated":                 RepoUpdatedEvent{},
 	"issue:created":                IssueCreatedEvent{},
 	"issue:updated":                IssueUpdatedEvent{},
 	"issue:comment_created":        IssueCommentCreatedEvent{},
@@ -63,49 +129,206 @@ var eventTypeMap = map[string]interface{}{
 	"pull_request:comment_deleted": PullRequestCommentDeletedEvent{},
 }
 
+// SetSecret configures the shared secret Bitbucket Cloud signs the webhook
+// body with. When set, ServeHTTP verifies the `X-Hub-Signature: sha256=<hex>`
+// header on every request and rejects requests that don't match with a 401.
+func (wh *Webhook) SetSecret(secret string) {
+	wh.secret = []byte(secret)
+}
+
+// SetExpectedUUID configures the webhook UUID Bitbucket Cloud sends in the
+// `X-Hook-UUID` header. When set, ServeHTTP compares it in constant time and
+// rejects requests that don't match with a 401.
+func (wh *Webhook) SetExpectedUUID(uuid string) {
+	wh.expectedUUID = uuid
+}
+
+// Parse reads the X-Event-Key header off r, checks it against the caller
+// supplied allowlist of events, and JSON-decodes the body into a fresh value
+// of the registered payload type for that event, returning a pointer to it.
+// It does not consult registered handlers and can be used independently of
+// Handle/ServeHTTP by callers that want to inspect an event before deciding
+// how to dispatch it.
+func (wh *Webhook) Parse(r *http.Request, events ...string) (interface{}, error) {
+	if r.Method != http.MethodPost {
+		return nil, ErrInvalidHTTPMethod
+	}
+
+	eventKey := r.Header.Get("X-Event-Key")
+	if eventKey == "" {
+		return nil, ErrMissingEventKeyHeader
+	}
+
+	allowed := false
+	for _, e := range events {
+		if e == eventKey {
+			allowed = true
+			break
+		}
+	}
+	if !allowed {
+		return nil, ErrEventNotFound
+	}
+
+	t, ok := eventTypeMap[eventKey]
+	if !ok {
+		return nil, ErrEventNotFound
+	}
+
+	event := reflect.New(reflect.TypeOf(t)).Elem().Addr().Interface()
+	if err := json.NewDecoder(r.Body).Decode(event); err != nil {
+		return nil, fmt.Errorf("%w: %s", ErrParsingPayload, err)
+	}
+
+	return event, nil
+}
+
 // ServeHTTP implements the http.Handler interface. It extracts the request
 // headers, maps the event key to the correct payload event type, parses the
 // JSON payload and calls the registered WebHookHandler passing the headers and
 // eventy type. A 400 Bad Request response is sent for any request made to
-// an event that doesn't have a registered handler.
+// an event that doesn't have a registered handler. If SetSecret or
+// SetExpectedUUID have been called, requests that fail verification get a
+// 401 Unauthorized response instead. If WithAsync has been called, the
+// handler is called by a worker instead, and ServeHTTP responds 202
+// Accepted as soon as the event is queued (see serveAsync).
 func (wh *Webhook) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	headers := Headers{}
-	for _, header := range []string{"X-Event-Key"} {
+	for _, header := range []string{"X-Event-Key", "X-Hook-UUID", "X-Hub-Signature"} {
 		headers[header] = r.Header.Get(header)
 	}
 
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		log.Printf("Error reading the body: %s", err)
+		http.Error(w, "Read error: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if len(wh.secret) > 0 {
+		if !validSignature(wh.secret, body, headers["X-Hub-Signature"]) {
+			wh.unauthorized(w, r, "Invalid X-Hub-Signature")
+			return
+		}
+	}
+
+	if wh.expectedUUID != "" {
+		if subtle.ConstantTimeCompare([]byte(wh.expectedUUID), []byte(headers["X-Hook-UUID"])) != 1 {
+			wh.unauthorized(w, r, "Invalid X-Hook-UUID")
+			return
+		}
+	}
+
 	eventKey := headers["X-Event-Key"]
 	if eventKey == "" {
 		wh.badRequest(w, r, "Missing X-Event-Key")
 		return
 	}
 
-	handler, ok := wh.handlers[eventKey]
-	if !ok {
-		wh.badRequest(w, r, "No handler for the event key: %s", eventKey)
+	if wh.queue != nil {
+		wh.serveAsync(w, r, headers, eventKey, body)
 		return
 	}
 
-	t, ok := eventTypeMap[eventKey]
-	if !ok {
-		wh.badRequest(w, r, "Unsupported event key type: %s", eventKey)
+	if !wh.hasAnyHandlerFor(eventKey) {
+		wh.badRequest(w, r, "No handler for the event key: %s", eventKey)
 		return
 	}
 
-	event := reflect.New(reflect.TypeOf(t)).Elem().Addr().Interface()
-	err := json.NewDecoder(r.Body).Decode(event)
+	r.Body = ioutil.NopCloser(bytes.NewReader(body))
+	event, err := wh.Parse(r, eventKey)
 	if err != nil {
-		log.Printf("Error parsing the body: %s", err)
-		http.Error(w, "Read error: "+err.Error(), http.StatusBadRequest)
+		wh.badRequest(w, r, "Error parsing the event: %s", err)
 		return
 	}
 
-	err = handler(headers, event)
-	if err != nil {
+	if err := wh.dispatch(eventKey, headers, event); err != nil {
 		wh.badRequest(w, r, "Error handling the event: %s", err)
 		return
 	}
+}
+
+// dispatch calls, in order, the Handle callback registered for eventKey (if
+// any), HandleAny (if registered), and any HandleKind callbacks matching
+// eventKey's EventKind and Action. It stops and returns the first error
+// encountered.
+func (wh *Webhook) dispatch(eventKey string, headers Headers, event interface{}) error {
+	if handler, ok := wh.handlers[eventKey]; ok {
+		if err := handler(headers, event); err != nil {
+			return err
+		}
+	}
+
+	if wh.anyHandler == nil && !wh.hasKindHandlerFor(eventKey) {
+		return nil
+	}
+
+	canonical, err := ToCanonical(eventKey, event)
+	if err != nil {
+		return nil
+	}
+
+	if wh.anyHandler != nil {
+		if err := wh.anyHandler(headers, canonical); err != nil {
+			return err
+		}
+	}
 
+	for _, kh := range wh.kindHandlers {
+		if !kh.matches(canonical.Kind(), canonical.Action()) {
+			continue
+		}
+		if err := kh.handler(headers, canonical); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// hasKindHandler reports whether a HandleKind callback is registered for
+// kind/action.
+func (wh *Webhook) hasKindHandler(kind EventKind, action Action) bool {
+	for _, kh := range wh.kindHandlers {
+		if kh.matches(kind, action) {
+			return true
+		}
+	}
+	return false
+}
+
+// hasKindHandlerFor reports whether a HandleKind callback matches eventKey's
+// EventKind and Action.
+func (wh *Webhook) hasKindHandlerFor(eventKey string) bool {
+	ka, ok := eventKindActions[eventKey]
+	return ok && wh.hasKindHandler(ka.kind, ka.action)
+}
+
+// hasAnyHandlerFor reports whether eventKey would be dispatched to at least
+// one of: a Handle callback, HandleAny, or a matching HandleKind callback.
+func (wh *Webhook) hasAnyHandlerFor(eventKey string) bool {
+	if _, ok := wh.handlers[eventKey]; ok {
+		return true
+	}
+	return wh.anyHandler != nil || wh.hasKindHandlerFor(eventKey)
+}
+
+// validSignature reports whether sig (the raw `X-Hub-Signature` header value,
+// e.g. "sha256=abcd...") is the HMAC-SHA256 of body using secret.
+func validSignature(secret, body []byte, sig string) bool {
+	const prefix = "sha256="
+	if !strings.HasPrefix(sig, prefix) {
+		return false
+	}
+
+	expected, err := hex.DecodeString(strings.TrimPrefix(sig, prefix))
+	if err != nil {
+		return false
+	}
+
+	mac := hmac.New(sha256.New, secret)
+	mac.Write(body)
+	return hmac.Equal(expected, mac.Sum(nil))
 }
 
 // Handle is called to register a webhook handler for the expected eventKey. See
@@ -114,6 +337,26 @@ func (wh *Webhook) Handle(eventKey string, handler WebhookHandler) {
 	wh.handlers[eventKey] = handler
 }
 
+// HandleAny registers a catch-all handler called with the CanonicalEvent for
+// every event ServeHTTP can build one for, regardless of event key. It runs
+// in addition to any handler registered with Handle or HandleKind.
+func (wh *Webhook) HandleAny(handler CanonicalHandler) {
+	wh.anyHandler = handler
+}
+
+// HandleKind registers a handler called with the CanonicalEvent for every
+// event of the given EventKind. If actions is non-empty, the handler only
+// runs for events whose Action is in that set, e.g.
+//
+//	wh.HandleKind(bitbucket.KindPullRequest, onPRClosed, bitbucket.ActionMerge, bitbucket.ActionClose)
+//
+// lets a single handler react to a pull request being closed, whether it was
+// merged or rejected, without duplicating logic across Handle callbacks. It
+// runs in addition to any handler registered with Handle or HandleAny.
+func (wh *Webhook) HandleKind(kind EventKind, handler CanonicalHandler, actions ...Action) {
+	wh.kindHandlers = append(wh.kindHandlers, kindHandler{kind: kind, actions: actions, handler: handler})
+}
+
 func (wh *Webhook) badRequest(w http.ResponseWriter, r *http.Request, msg string, p ...interface{}) {
 	fmsg := fmt.Sprintf(msg, p...)
 	if wh.LogOnError != nil {
@@ -121,3 +364,19 @@ func (wh *Webhook) badRequest(w http.ResponseWriter, r *http.Request, msg string
 	}
 	http.Error(w, fmsg, http.StatusBadRequest)
 }
+
+func (wh *Webhook) unauthorized(w http.ResponseWriter, r *http.Request, msg string, p ...interface{}) {
+	fmsg := fmt.Sprintf(msg, p...)
+	if wh.LogOnError != nil {
+		wh.LogOnError(fmsg)
+	}
+	http.Error(w, fmsg, http.StatusUnauthorized)
+}
+
+func (wh *Webhook) unavailable(w http.ResponseWriter, r *http.Request, msg string, p ...interface{}) {
+	fmsg := fmt.Sprintf(msg, p...)
+	if wh.LogOnError != nil {
+		wh.LogOnError(fmsg)
+	}
+	http.Error(w, fmsg, http.StatusServiceUnavailable)
+}
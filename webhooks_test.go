@@ -2,10 +2,14 @@ package bitbucket
 
 import (
 	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
 	"io/ioutil"
 	"log"
 	"net/http"
 	"net/http/httptest"
+	"strings"
 	"testing"
 
 	"github.com/stretchr/testify/assert"
@@ -53,6 +57,16 @@ func TestEvents(t *testing.T) {
 		// TODO: repo:commit_status_created
 		// TODO: repo:commit_status_updated
 
+		{"repo:updated", func(h Headers, e interface{}) error {
+			ru := e.(*RepoUpdatedEvent)
+			assert.NotNil(t, ru)
+			assert.Equal(t, "test-repo-updated", ru.Repository.Name)
+			assert.Equal(t, "test-repo", ru.Changes.Name.Old)
+			assert.Equal(t, "test-repo-updated", ru.Changes.Name.New)
+			assert.True(t, ru.Changes.IsPrivate.New)
+			return nil
+		}, "repo_updated_event.json"},
+
 		{"issue:created", func(h Headers, e interface{}) error {
 			ic := e.(*IssueCreatedEvent)
 			assert.NotNil(t, ic)
@@ -73,17 +87,79 @@ func TestEvents(t *testing.T) {
 			return nil
 		}, "issue_updated_event.json"},
 
-		// TODO: issue:comment_created
-		// TODO: pullrequest:created
-		// TODO: pullrequest:updated
-		// TODO: pullrequest:approved
-		// TODO: pullrequest:unapproved
-		// TODO: pullrequest:fulfilled
-		// TODO: pullrequest:rejected
-		// TODO: pullrequest:comment_created
-		// TODO: pullrequest:comment_updated
-		// TODO: pull_request:comment_deleted
+		{"issue:comment_created", func(h Headers, e interface{}) error {
+			icc := e.(*IssueCommentCreatedEvent)
+			assert.NotNil(t, icc)
+			assert.Equal(t, "This is a comment", icc.Comment.Content.Raw)
+			assert.Equal(t, "test-repo", icc.Repository.Name)
+			return nil
+		}, "issue_comment_created_event.json"},
+
+		{"pullrequest:created", func(h Headers, e interface{}) error {
+			pr := e.(*PullRequestCreatedEvent)
+			assert.NotNil(t, pr)
+			assert.Equal(t, "Add a new feature", pr.PullRequest.Title)
+			assert.Equal(t, "OPEN", pr.PullRequest.State)
+			return nil
+		}, "pullrequest_created_event.json"},
+
+		{"pullrequest:updated", func(h Headers, e interface{}) error {
+			pr := e.(*PullRequestUpdatedEvent)
+			assert.NotNil(t, pr)
+			assert.Equal(t, "This adds a new feature, updated.", pr.PullRequest.Description)
+			return nil
+		}, "pullrequest_updated_event.json"},
+
+		{"pullrequest:approved", func(h Headers, e interface{}) error {
+			pr := e.(*PullRequestApprovedEvent)
+			assert.NotNil(t, pr)
+			assert.Equal(t, "reviewer", pr.Approval.User.Username)
+			return nil
+		}, "pullrequest_approved_event.json"},
+
+		{"pullrequest:unapproved", func(h Headers, e interface{}) error {
+			pr := e.(*PullRequestApprovalRemovedEvent)
+			assert.NotNil(t, pr)
+			assert.Equal(t, "reviewer", pr.Approval.User.Username)
+			return nil
+		}, "pullrequest_unapproved_event.json"},
+
+		{"pullrequest:fulfilled", func(h Headers, e interface{}) error {
+			pr := e.(*PullRequestMergedEvent)
+			assert.NotNil(t, pr)
+			assert.Equal(t, "MERGED", pr.PullRequest.State)
+			assert.Equal(t, "f6e5d4c", pr.PullRequest.MergeCommit.Hash)
+			return nil
+		}, "pullrequest_fulfilled_event.json"},
+
+		{"pullrequest:rejected", func(h Headers, e interface{}) error {
+			pr := e.(*PullRequestDeclinedEvent)
+			assert.NotNil(t, pr)
+			assert.Equal(t, "DECLINED", pr.PullRequest.State)
+			assert.Equal(t, "Not needed anymore.", pr.PullRequest.Reason)
+			return nil
+		}, "pullrequest_rejected_event.json"},
+
+		{"pullrequest:comment_created", func(h Headers, e interface{}) error {
+			prc := e.(*PullRequestCommentCreatedEvent)
+			assert.NotNil(t, prc)
+			assert.Equal(t, "This is a pull request comment", prc.Comment.Content.Raw)
+			return nil
+		}, "pullrequest_comment_created_event.json"},
+
+		{"pullrequest:comment_updated", func(h Headers, e interface{}) error {
+			prc := e.(*PullRequestCommentUpdatedEvent)
+			assert.NotNil(t, prc)
+			assert.Equal(t, "This is an updated pull request comment", prc.Comment.Content.Raw)
+			return nil
+		}, "pullrequest_comment_updated_event.json"},
 
+		{"pull_request:comment_deleted", func(h Headers, e interface{}) error {
+			prc := e.(*PullRequestCommentDeletedEvent)
+			assert.NotNil(t, prc)
+			assert.Equal(t, "This comment was deleted", prc.Comment.Content.Raw)
+			return nil
+		}, "pull_request_comment_deleted_event.json"},
 	} {
 		called := false
 		wh.Handle(fix.event, func(h Headers, e interface{}) error {
@@ -108,6 +184,213 @@ func TestEvents(t *testing.T) {
 
 }
 
+func TestHandleKindAndHandleAny(t *testing.T) {
+	wh := NewWebhook()
+
+	var anyKinds []EventKind
+	wh.HandleAny(func(h Headers, e CanonicalEvent) error {
+		anyKinds = append(anyKinds, e.Kind())
+		return nil
+	})
+
+	var closedActions []Action
+	wh.HandleKind(KindPullRequest, func(h Headers, e CanonicalEvent) error {
+		closedActions = append(closedActions, e.Action())
+		return nil
+	}, ActionMerge, ActionClose)
+
+	for _, event := range []string{"pullrequest:fulfilled", "pullrequest:rejected", "pullrequest:approved"} {
+		jsn, err := ioutil.ReadFile("fixtures/pullrequest_" + strings.TrimPrefix(event, "pullrequest:") + "_event.json")
+		require.Nil(t, err)
+
+		rec := httptest.NewRecorder()
+		req, err := http.NewRequest("POST", "http://example.com", bytes.NewReader(jsn))
+		require.Nil(t, err)
+		req.Header.Add("X-Event-Key", event)
+
+		wh.ServeHTTP(rec, req)
+		require.Equal(t, http.StatusOK, rec.Code)
+	}
+
+	assert.Equal(t, []EventKind{KindPullRequest, KindPullRequest, KindPullRequest}, anyKinds)
+	assert.Equal(t, []Action{ActionMerge, ActionClose}, closedActions)
+}
+
+func TestParse(t *testing.T) {
+	jsn, err := ioutil.ReadFile("fixtures/pullrequest_approved_event.json")
+	require.Nil(t, err)
+
+	t.Run("happy path", func(t *testing.T) {
+		wh := NewWebhook()
+		req, err := http.NewRequest("POST", "http://example.com", bytes.NewReader(jsn))
+		require.Nil(t, err)
+		req.Header.Add("X-Event-Key", "pullrequest:approved")
+
+		event, err := wh.Parse(req, "pullrequest:approved", "pullrequest:unapproved")
+		require.NoError(t, err)
+
+		pr, ok := event.(*PullRequestApprovedEvent)
+		require.True(t, ok)
+		assert.Equal(t, "reviewer", pr.Approval.User.Username)
+	})
+
+	t.Run("invalid HTTP method", func(t *testing.T) {
+		wh := NewWebhook()
+		req, err := http.NewRequest("GET", "http://example.com", bytes.NewReader(jsn))
+		require.Nil(t, err)
+		req.Header.Add("X-Event-Key", "pullrequest:approved")
+
+		_, err = wh.Parse(req, "pullrequest:approved")
+		require.ErrorIs(t, err, ErrInvalidHTTPMethod)
+	})
+
+	t.Run("missing X-Event-Key header", func(t *testing.T) {
+		wh := NewWebhook()
+		req, err := http.NewRequest("POST", "http://example.com", bytes.NewReader(jsn))
+		require.Nil(t, err)
+
+		_, err = wh.Parse(req, "pullrequest:approved")
+		require.ErrorIs(t, err, ErrMissingEventKeyHeader)
+	})
+
+	t.Run("event key not in the allowlist", func(t *testing.T) {
+		wh := NewWebhook()
+		req, err := http.NewRequest("POST", "http://example.com", bytes.NewReader(jsn))
+		require.Nil(t, err)
+		req.Header.Add("X-Event-Key", "pullrequest:approved")
+
+		_, err = wh.Parse(req, "pullrequest:unapproved")
+		require.ErrorIs(t, err, ErrEventNotFound)
+	})
+
+	t.Run("event key with no known payload type", func(t *testing.T) {
+		wh := NewWebhook()
+		req, err := http.NewRequest("POST", "http://example.com", bytes.NewReader(jsn))
+		require.Nil(t, err)
+		req.Header.Add("X-Event-Key", "repo:imaginary_event")
+
+		_, err = wh.Parse(req, "repo:imaginary_event")
+		require.ErrorIs(t, err, ErrEventNotFound)
+	})
+
+	t.Run("malformed JSON body", func(t *testing.T) {
+		wh := NewWebhook()
+		req, err := http.NewRequest("POST", "http://example.com", strings.NewReader("not json"))
+		require.Nil(t, err)
+		req.Header.Add("X-Event-Key", "pullrequest:approved")
+
+		_, err = wh.Parse(req, "pullrequest:approved")
+		require.ErrorIs(t, err, ErrParsingPayload)
+	})
+}
+
+func TestSignatureVerification(t *testing.T) {
+	secret := "shhh"
+	jsn, err := ioutil.ReadFile("fixtures/pullrequest_approved_event.json")
+	require.Nil(t, err)
+
+	sign := func(body []byte) string {
+		mac := hmac.New(sha256.New, []byte(secret))
+		mac.Write(body)
+		return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+	}
+
+	newRequest := func(sig string) *http.Request {
+		req, err := http.NewRequest("POST", "http://example.com", bytes.NewReader(jsn))
+		require.Nil(t, err)
+		req.Header.Add("X-Event-Key", "pullrequest:approved")
+		if sig != "" {
+			req.Header.Add("X-Hub-Signature", sig)
+		}
+		return req
+	}
+
+	t.Run("valid signature is accepted", func(t *testing.T) {
+		wh := NewWebhook()
+		wh.SetSecret(secret)
+		wh.Handle("pullrequest:approved", func(h Headers, e interface{}) error { return nil })
+
+		rec := httptest.NewRecorder()
+		wh.ServeHTTP(rec, newRequest(sign(jsn)))
+		require.Equal(t, http.StatusOK, rec.Code)
+	})
+
+	t.Run("tampered body is rejected", func(t *testing.T) {
+		wh := NewWebhook()
+		wh.SetSecret(secret)
+		wh.Handle("pullrequest:approved", func(h Headers, e interface{}) error { return nil })
+
+		sig := sign(jsn)
+		tampered, err := ioutil.ReadFile("fixtures/pullrequest_approved_event.json")
+		require.Nil(t, err)
+		tampered = append(tampered, ' ')
+
+		rec := httptest.NewRecorder()
+		req, err := http.NewRequest("POST", "http://example.com", bytes.NewReader(tampered))
+		require.Nil(t, err)
+		req.Header.Add("X-Event-Key", "pullrequest:approved")
+		req.Header.Add("X-Hub-Signature", sig)
+
+		wh.ServeHTTP(rec, req)
+		require.Equal(t, http.StatusUnauthorized, rec.Code)
+	})
+
+	t.Run("missing sha256 prefix is rejected", func(t *testing.T) {
+		wh := NewWebhook()
+		wh.SetSecret(secret)
+		wh.Handle("pullrequest:approved", func(h Headers, e interface{}) error { return nil })
+
+		rec := httptest.NewRecorder()
+		wh.ServeHTTP(rec, newRequest(hex.EncodeToString([]byte("not-prefixed"))))
+		require.Equal(t, http.StatusUnauthorized, rec.Code)
+	})
+
+	t.Run("invalid hex is rejected", func(t *testing.T) {
+		wh := NewWebhook()
+		wh.SetSecret(secret)
+		wh.Handle("pullrequest:approved", func(h Headers, e interface{}) error { return nil })
+
+		rec := httptest.NewRecorder()
+		wh.ServeHTTP(rec, newRequest("sha256=not-hex"))
+		require.Equal(t, http.StatusUnauthorized, rec.Code)
+	})
+
+	t.Run("matching X-Hook-UUID is accepted", func(t *testing.T) {
+		wh := NewWebhook()
+		wh.SetExpectedUUID("expected-uuid")
+		wh.Handle("pullrequest:approved", func(h Headers, e interface{}) error { return nil })
+
+		req := newRequest("")
+		req.Header.Add("X-Hook-UUID", "expected-uuid")
+
+		rec := httptest.NewRecorder()
+		wh.ServeHTTP(rec, req)
+		require.Equal(t, http.StatusOK, rec.Code)
+	})
+
+	t.Run("mismatched X-Hook-UUID is rejected", func(t *testing.T) {
+		wh := NewWebhook()
+		wh.SetExpectedUUID("expected-uuid")
+		wh.Handle("pullrequest:approved", func(h Headers, e interface{}) error { return nil })
+
+		req := newRequest("")
+		req.Header.Add("X-Hook-UUID", "wrong-uuid")
+
+		rec := httptest.NewRecorder()
+		wh.ServeHTTP(rec, req)
+		require.Equal(t, http.StatusUnauthorized, rec.Code)
+	})
+
+	t.Run("no secret or expected UUID configured skips verification", func(t *testing.T) {
+		wh := NewWebhook()
+		wh.Handle("pullrequest:approved", func(h Headers, e interface{}) error { return nil })
+
+		rec := httptest.NewRecorder()
+		wh.ServeHTTP(rec, newRequest(""))
+		require.Equal(t, http.StatusOK, rec.Code)
+	})
+}
+
 func Example() {
 	wh := NewWebhook()
 	wh.Handle("repo:push", func(headers Headers, event interface{}) error {